@@ -0,0 +1,179 @@
+package drain
+
+import (
+	"context"
+	"time"
+)
+
+// CompactStats summarises the outcome of a single Compact pass, so
+// operators can tune MergeSimTh and CompactionInterval from real
+// numbers instead of guessing.
+type CompactStats struct {
+	// Visited is the number of clusters considered across every leaf.
+	Visited int
+	// Merged is the number of clusters folded into a survivor and
+	// removed.
+	Merged int
+	// Duration is how long the pass took.
+	Duration time.Duration
+}
+
+// Compact walks every first-level bucket of the prefix tree (clusters are
+// grouped by token count there) and folds clusters whose templates are
+// near-duplicates (similarity at or above Config.MergeSimTh) into a
+// single survivor, to bound the steady growth of near-identical templates
+// that addSeqToPrefixTree can otherwise leave behind. Clusters are
+// compared across every leaf within a bucket, not just within one leaf's
+// clusterIDs, since templates that diverge on an early token but agree
+// past it live under different leaves and would otherwise never be
+// compared. Compact does not schedule itself; callers should invoke it on
+// their own ticker, e.g. at Config.CompactionInterval.
+func (d *Drain) Compact(ctx context.Context) (CompactStats, error) {
+	start := time.Now()
+	mergeSimTh := d.config.MergeSimTh
+	if mergeSimTh <= 0 {
+		mergeSimTh = defaultMergeSimTh
+	}
+
+	var stats CompactStats
+	err := d.walkBuckets(d.rootNode, func(leaves []*Node) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		visited, merged := d.compactBucket(leaves, mergeSimTh)
+		stats.Visited += visited
+		stats.Merged += merged
+		return nil
+	})
+	stats.Duration = time.Since(start)
+	return stats, err
+}
+
+// walkBuckets calls fn once per first-level (token-count) bucket of the
+// tree, passing every leaf node found beneath it. All clusters reachable
+// through a bucket share the same token count, so they remain directly
+// comparable via getSeqDistance regardless of which leaf they ended up
+// under.
+func (d *Drain) walkBuckets(root *Node, fn func([]*Node) error) error {
+	for _, bucket := range root.keyToChildNode {
+		var leaves []*Node
+		collectLeaves(bucket, &leaves)
+		if len(leaves) == 0 {
+			continue
+		}
+		if err := fn(leaves); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectLeaves appends every node carrying clusters beneath n, depth-first.
+func collectLeaves(n *Node, out *[]*Node) {
+	if len(n.clusterIDs) > 0 {
+		*out = append(*out, n)
+	}
+	for _, child := range n.keyToChildNode {
+		collectLeaves(child, out)
+	}
+}
+
+// leafCluster pairs a cluster ID with the leaf it was read from, so
+// compactBucket can rewrite each leaf's clusterIDs afterwards
+// even though clusters being compared may come from different leaves.
+type leafCluster struct {
+	node *Node
+	id   int
+}
+
+// compactBucket greedily merges clusters across every leaf in a bucket
+// whose pairwise similarity is at or above mergeSimTh, then rewrites
+// every leaf's clusterIDs. A leaf whose cluster was merged away keeps a
+// reference to the survivor rather than losing it outright: treeSearch
+// still routes incoming lines down that leaf by their literal tokens, so
+// without the survivor registered there those lines would stop matching
+// anything, even though a near-duplicate template now exists elsewhere
+// in the bucket.
+func (d *Drain) compactBucket(leaves []*Node, mergeSimTh float64) (visited, merged int) {
+	var refs []leafCluster
+	var clusters []*LogCluster
+	for _, n := range leaves {
+		for _, id := range n.clusterIDs {
+			refs = append(refs, leafCluster{node: n, id: id})
+			clusters = append(clusters, d.idToCluster.Get(id))
+			visited++
+		}
+	}
+
+	survivorID := make([]int, len(clusters))
+	for i, ref := range refs {
+		survivorID[i] = ref.id
+	}
+
+	dead := make([]bool, len(clusters))
+	for i := range clusters {
+		if clusters[i] == nil || dead[i] {
+			continue
+		}
+		for j := i + 1; j < len(clusters); j++ {
+			if clusters[j] == nil || dead[j] || clusters[i] == clusters[j] {
+				continue
+			}
+			sim, _ := d.getSeqDistance(clusters[i].Tokens, clusters[j].Tokens, true)
+			if sim < mergeSimTh {
+				continue
+			}
+			d.mergeClusters(clusters[i], clusters[j])
+			d.idToCluster.Remove(refs[j].id)
+			// A cluster may be listed under several leaves (e.g. a
+			// survivor of an earlier pass): retire every occurrence,
+			// and repoint anything that referenced it at the survivor.
+			loserID := clusters[j].id
+			for k := range clusters {
+				if clusters[k] == clusters[j] {
+					dead[k] = true
+				}
+				if survivorID[k] == loserID {
+					survivorID[k] = clusters[i].id
+				}
+			}
+			merged++
+		}
+	}
+
+	alive := make(map[*Node]map[int]bool, len(leaves))
+	for i, ref := range refs {
+		if clusters[i] == nil {
+			continue
+		}
+		ids := alive[ref.node]
+		if ids == nil {
+			ids = make(map[int]bool)
+			alive[ref.node] = ids
+		}
+		ids[survivorID[i]] = true
+	}
+	for _, n := range leaves {
+		ids := alive[n]
+		clusterIDs := make([]int, 0, len(ids))
+		for id := range ids {
+			clusterIDs = append(clusterIDs, id)
+		}
+		n.clusterIDs = clusterIDs
+	}
+	return visited, merged
+}
+
+// mergeClusters folds loser into survivor: their templates are unioned,
+// Size sums, Samples are combined population-weighted via mergeSamples
+// (not replayed through SampleStrategy.Append, which would treat each of
+// loser's already-downsampled Samples as a single new arrival and
+// understate however much larger loser's true population was), and
+// Volume.Values are merged bucket-by-bucket.
+func (d *Drain) mergeClusters(survivor, loser *LogCluster) {
+	survivor.Tokens = d.createTemplate(survivor.Tokens, loser.Tokens)
+	survivor.Size += loser.Size
+	survivor.Samples, survivor.sampleK = mergeSamples(
+		survivor.Samples, survivor.sampleK, loser.Samples, loser.sampleK, d.config.MaxSamples)
+	survivor.Volume.Values = mergeVolumeValues(survivor.Volume.Values, loser.Volume.Values)
+}
@@ -0,0 +1,56 @@
+package drain
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// TestCompactPreservesMatch is a randomized, seeded check that Compact
+// never makes a previously-trained line unmatchable. The word lists
+// below vary the first token across four values (alpha/bravo/...),
+// which puts otherwise similar lines under different leaves, while the
+// later positions draw from small word sets, so that near-duplicate
+// templates exist for cross-leaf compaction to fold together. For many random training
+// sequences, every line trained is still found by Match once
+// compaction has run.
+func TestCompactPreservesMatch(t *testing.T) {
+	words := [][]string{
+		{"alpha", "bravo", "charlie", "delta"},
+		{"user"},
+		{"logged", "signed"},
+		{"in", "out"},
+		{"successfully", "unsuccessfully"},
+		{"today", "yesterday"},
+	}
+
+	for seed := int64(0); seed < 50; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+
+		cfg := DefaultConfig()
+		cfg.MergeSimTh = 0.5
+		d := New(cfg)
+
+		var lines []string
+		for i := 0; i < 40; i++ {
+			parts := make([]string, len(words))
+			for j, options := range words {
+				parts[j] = options[rng.Intn(len(options))]
+			}
+			line := fmt.Sprintf("%s %s %s %s %s %s", parts[0], parts[1], parts[2], parts[3], parts[4], parts[5])
+			lines = append(lines, line)
+			d.Train(line, int64(i)*timeResolution)
+		}
+
+		if _, err := d.Compact(context.Background()); err != nil {
+			t.Fatalf("seed %d: Compact: %v", seed, err)
+		}
+
+		for _, line := range lines {
+			if d.Match(line) == nil {
+				t.Fatalf("seed %d: Match(%q) = nil after Compact", seed, line)
+			}
+		}
+	}
+}
@@ -42,6 +42,41 @@ type Config struct {
 	ExtraDelimiters []string
 	MaxClusters     int
 	ParamString     string
+
+	// BurstThreshold is the EMA multiplier Drain.IsBursting passes to
+	// Volume.IsBurst. DefaultConfig sets it to 3; left zero, IsBursting
+	// always reports false.
+	BurstThreshold float64
+	// EMATimeConstant controls how quickly a Volume's rate EMA responds
+	// to new samples. Zero falls back to defaultEMATimeConstant.
+	EMATimeConstant time.Duration
+
+	// Maskers is the ordered pipeline of regex-based rules run over
+	// content before it is split into tokens, so that high-cardinality
+	// substrings (IPs, UUIDs, hashes, ...) collapse to a stable token
+	// instead of inflating MaxChildren. Nil disables masking.
+	Maskers []MaskRule
+
+	// MaxSamples caps how many raw lines a cluster retains in Samples.
+	// Zero falls back to the package default of 10.
+	MaxSamples int
+	// SampleStrategy decides which lines survive once MaxSamples is
+	// reached. Nil falls back to FirstN, matching Drain's original
+	// behaviour.
+	SampleStrategy SampleStrategy
+
+	// MergeSimTh is the similarity threshold at or above which Compact
+	// merges two clusters with the same token count, whichever leaves of
+	// that token-count bucket they sit under. It should generally sit
+	// above SimTh, since compaction is meant to fold in near-duplicates
+	// rather than loosely related templates. Zero falls back to
+	// defaultMergeSimTh.
+	MergeSimTh float64
+	// CompactionInterval is how often callers should invoke Compact to
+	// keep template drift bounded. Drain does not schedule compaction
+	// itself; this is advisory for whatever ticker or loop the caller
+	// runs Compact from.
+	CompactionInterval time.Duration
 }
 
 type LogCluster struct {
@@ -51,13 +86,39 @@ type LogCluster struct {
 
 	Samples []string
 	Volume  Volume
+
+	// sampleK is the number of lines this cluster has ever seen,
+	// tracked independently of len(Samples) for sample strategies (e.g.
+	// ReservoirN) that need it to stay unbiased over the cluster's
+	// whole lifetime.
+	sampleK int
 }
 
 const (
 	timeResolution = int64(time.Second * 10)
 	maxSamples     = 10
 
+	// coincidentNs is the rate-sample interval Volume.sample falls back
+	// to when two Add calls arrive with an equal or decreasing
+	// timestamp (batched pushes, coarse clocks, concurrent shards), so
+	// those arrivals still count toward rEMA/rPeak instead of being
+	// silently dropped. It stands in for a plausible minimum
+	// inter-arrival time, not the literal elapsed time (which is
+	// unknown); a millisecond keeps the implied rate (1000/s) high
+	// enough to read as a burst without pinning rPeak, a running max
+	// that never decays, at an implausible ceiling the way a
+	// nanosecond-scale floor would.
+	coincidentNs = int64(time.Millisecond)
+
 	defaultVolumeSize = 500
+
+	// defaultEMATimeConstant is the smoothing window used for Volume's
+	// rate EMA when Config.EMATimeConstant is left unset.
+	defaultEMATimeConstant = 30 * time.Second
+
+	// defaultMergeSimTh is the similarity threshold Compact uses when
+	// Config.MergeSimTh is left unset.
+	defaultMergeSimTh = 0.7
 )
 
 func (c *LogCluster) getTemplate() string {
@@ -72,10 +133,25 @@ func truncateTimestamp(ts int64) int64 { return ts - ts%timeResolution }
 
 type Volume struct {
 	Values [][2]int64 // 0 timestamp, 1 count.
+
+	// rEMA and rPeak track an exponential moving average and the
+	// highest observed instantaneous rate of Add calls, in matches per
+	// second. rLast holds the most recent instantaneous rate, and
+	// lastSampleNs the raw timestamp (as passed to Add) it was computed
+	// from, so that bursts can be detected without rescanning Values.
+	rEMA         float64
+	rPeak        float64
+	rLast        float64
+	lastSampleNs int64
+	emaTau       time.Duration
 }
 
-func initVolume(ts int64) Volume {
-	v := Volume{Values: make([][2]int64, 1, defaultVolumeSize)}
+func initVolume(ts int64, emaTau time.Duration) Volume {
+	v := Volume{
+		Values:       make([][2]int64, 1, defaultVolumeSize),
+		lastSampleNs: ts,
+		emaTau:       emaTau,
+	}
 	v.Values[0] = [2]int64{ts, 1}
 	return v
 }
@@ -118,6 +194,7 @@ func (x *Volume) Matches() int64 {
 }
 
 func (x *Volume) Add(ts int64) {
+	x.sample(ts)
 	t := truncateTimestamp(ts)
 	first := x.Values[0][0] // can't be empty
 	last := x.Values[len(x.Values)-1][0]
@@ -146,12 +223,52 @@ func (x *Volume) Add(ts int64) {
 	}
 }
 
-func (c *LogCluster) append(content string, ts int64) {
-	c.Volume.Add(ts)
-	// TODO: Should we sample lines randomly? Keep last N?
-	if len(c.Samples) < maxSamples {
-		c.Samples = append(c.Samples, content)
+// sample updates the rate EMA and peak from the interval elapsed since the
+// previous Add call. The first sample of a Volume's lifetime only seeds
+// lastSampleNs, since there is no preceding interval to derive a rate
+// from. Ties and out-of-order timestamps (dt <= 0) are routine under
+// batched or concurrent ingestion and are exactly the high-throughput
+// condition bursts show up in, so each of those still counts as an
+// arrival at the current instant: coincidentNs floors dt at a plausible
+// minimum inter-arrival time instead of silently discarding the sample.
+func (x *Volume) sample(ts int64) {
+	dt := ts - x.lastSampleNs
+	if dt <= 0 {
+		dt = coincidentNs
+	}
+	tau := x.emaTau
+	if tau <= 0 {
+		tau = defaultEMATimeConstant
 	}
+	rSample := float64(time.Second) / float64(dt)
+	alpha := 1 - math.Exp(-float64(dt)/float64(tau))
+	x.rEMA = alpha*rSample + (1-alpha)*x.rEMA
+	x.rLast = rSample
+	if rSample > x.rPeak {
+		x.rPeak = rSample
+	}
+	x.lastSampleNs = ts
+}
+
+// Rate returns the current EMA and peak of the per-second match rate, as
+// maintained by Add.
+func (x *Volume) Rate() (ema, peak float64) {
+	return x.rEMA, x.rPeak
+}
+
+// IsBurst reports whether the most recent Add sample exceeded the EMA by
+// more than zScore, e.g. IsBurst(3) flags a sample at more than 3x the
+// rolling baseline rate.
+func (x *Volume) IsBurst(zScore float64) bool {
+	if zScore <= 0 || x.rEMA <= 0 {
+		return false
+	}
+	return x.rLast > x.rEMA*zScore
+}
+
+func (c *LogCluster) append(content string, ts int64, strategy SampleStrategy, max int) {
+	c.Volume.Add(ts)
+	c.Samples, c.sampleK = strategy.Append(c.Samples, c.sampleK, max, content)
 }
 
 func createLogClusterCache(maxSize int) *LogClusterCache {
@@ -200,6 +317,10 @@ func (c *LogClusterCache) Get(key int) *LogCluster {
 	return cluster.(*LogCluster)
 }
 
+func (c *LogClusterCache) Remove(key int) {
+	c.cache.Remove(key)
+}
+
 func createNode() *Node {
 	return &Node{
 		keyToChildNode: make(map[string]*Node),
@@ -218,19 +339,42 @@ func DefaultConfig() *Config {
 		SimTh:           0.4,
 		MaxChildren:     100,
 		ParamString:     "<*>",
+		BurstThreshold:  3,
+		EMATimeConstant: defaultEMATimeConstant,
+		Maskers:         DefaultMaskRules(),
+		MaxSamples:      maxSamples,
+		SampleStrategy:  FirstN{},
+		MergeSimTh:      defaultMergeSimTh,
 	}
 }
 
-func New(config *Config) *Drain {
+// setDefaults fills in config fields that New and LoadSnapshot both need
+// a usable value for, even when the caller built Config by hand instead
+// of starting from DefaultConfig.
+func (config *Config) setDefaults() {
 	if config.LogClusterDepth < 3 {
 		panic("depth argument must be at least 3")
 	}
 	config.maxNodeDepth = config.LogClusterDepth - 2
+	if config.MaxSamples == 0 {
+		config.MaxSamples = maxSamples
+	}
+	if config.SampleStrategy == nil {
+		config.SampleStrategy = FirstN{}
+	}
+	if config.MergeSimTh == 0 {
+		config.MergeSimTh = defaultMergeSimTh
+	}
+}
+
+func New(config *Config) *Drain {
+	config.setDefaults()
 
 	d := &Drain{
 		config:      config,
 		rootNode:    createNode(),
 		idToCluster: createLogClusterCache(config.MaxClusters),
+		masker:      NewMasker(config.Maskers),
 	}
 	return d
 }
@@ -240,16 +384,26 @@ type Drain struct {
 	rootNode        *Node
 	idToCluster     *LogClusterCache
 	clustersCounter int
+	masker          *Masker
 }
 
 func (d *Drain) Clusters() []*LogCluster {
 	return d.idToCluster.Values()
 }
 
+// Iterate calls fn for every known cluster until fn returns false. Callers
+// wanting to report or filter bursting clusters can combine this with
+// IsBursting, e.g. to skip clusters whose volume is not currently spiking.
 func (d *Drain) Iterate(fn func(*LogCluster) bool) {
 	d.idToCluster.Iterate(fn)
 }
 
+// IsBursting reports whether the cluster's volume is presently bursting,
+// per the configured BurstThreshold.
+func (d *Drain) IsBursting(c *LogCluster) bool {
+	return c.Volume.IsBurst(d.config.BurstThreshold)
+}
+
 func (d *Drain) Train(content string, ts int64) *LogCluster {
 	contentTokens := d.getContentAsTokens(content)
 
@@ -258,13 +412,16 @@ func (d *Drain) Train(content string, ts int64) *LogCluster {
 	if matchCluster == nil {
 		d.clustersCounter++
 		clusterID := d.clustersCounter
+		samples, sampleK := d.config.SampleStrategy.Append(nil, 0, d.config.MaxSamples, content)
 		matchCluster = &LogCluster{
 			Tokens: contentTokens,
 			id:     clusterID,
 			Size:   1,
 
-			Samples: []string{content},
-			Volume:  initVolume(ts),
+			Samples: samples,
+			Volume:  initVolume(ts, d.config.EMATimeConstant),
+
+			sampleK: sampleK,
 		}
 		d.idToCluster.Set(clusterID, matchCluster)
 		d.addSeqToPrefixTree(d.rootNode, matchCluster)
@@ -272,7 +429,7 @@ func (d *Drain) Train(content string, ts int64) *LogCluster {
 		newTemplateTokens := d.createTemplate(contentTokens, matchCluster.Tokens)
 		matchCluster.Tokens = newTemplateTokens
 		matchCluster.Size++
-		matchCluster.append(content, ts)
+		matchCluster.append(content, ts, d.config.SampleStrategy, d.config.MaxSamples)
 		// Touch cluster to update its state in the cache.
 		d.idToCluster.Get(matchCluster.id)
 	}
@@ -287,11 +444,27 @@ func (d *Drain) Match(content string) *LogCluster {
 }
 
 func (d *Drain) getContentAsTokens(content string) []string {
+	_, tokens := d.tokenize(content)
+	return tokens
+}
+
+// Explain runs content through the same masking and tokenisation
+// pipeline as Train and Match, without touching any cluster, so callers
+// can see which mask rules fired and what tokens a line would produce.
+func (d *Drain) Explain(content string) ([]MaskHit, []string) {
+	return d.tokenize(content)
+}
+
+func (d *Drain) tokenize(content string) ([]MaskHit, []string) {
 	content = strings.TrimSpace(content)
+	var hits []MaskHit
+	if d.masker != nil {
+		content, hits = d.masker.Apply(content)
+	}
 	for _, extraDelimiter := range d.config.ExtraDelimiters {
 		content = strings.Replace(content, extraDelimiter, " ", -1)
 	}
-	return strings.Split(content, " ")
+	return hits, strings.Split(content, " ")
 }
 
 func (d *Drain) treeSearch(rootNode *Node, tokens []string, simTh float64, includeParams bool) *LogCluster {
@@ -0,0 +1,114 @@
+package drain
+
+import (
+	"regexp"
+	"strings"
+)
+
+// MaskRule is a single ordered pass of a masking pipeline: any match of
+// Pattern in the input is replaced by Replacement before tokenisation.
+type MaskRule struct {
+	Name        string
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// MaskHit records that a rule fired on a piece of content and what
+// substring it matched, for Drain.Explain.
+type MaskHit struct {
+	Name  string
+	Match string
+}
+
+// Masker runs an ordered pipeline of MaskRules over raw log content
+// prior to tokenisation, collapsing high-cardinality substrings (UUIDs,
+// IPs, hex hashes, timestamps, ...) down to a single stable token so
+// they don't explode MaxChildren or pollute templates before hasNumbers
+// gets a chance to help.
+type Masker struct {
+	rules []MaskRule
+}
+
+// NewMasker builds a Masker that applies rules in order. A nil or empty
+// rules slice yields a Masker that leaves content untouched.
+func NewMasker(rules []MaskRule) *Masker {
+	return &Masker{rules: rules}
+}
+
+// Apply runs every rule over content in order and returns the masked
+// result along with the rules that fired, in match order. A rule is
+// skipped over any span that already contains a replacement emitted by
+// an earlier rule in this same pass, so a broad rule running late in the
+// pipeline (e.g. qstr matching an entire quoted string) cannot swallow
+// the more specific mask a prior rule already produced inside it.
+func (m *Masker) Apply(content string) (string, []MaskHit) {
+	if m == nil {
+		return content, nil
+	}
+	var hits []MaskHit
+	var applied []string
+	for _, rule := range m.rules {
+		content = rule.Pattern.ReplaceAllStringFunc(content, func(match string) string {
+			for _, placeholder := range applied {
+				if strings.Contains(match, placeholder) {
+					return match
+				}
+			}
+			hits = append(hits, MaskHit{Name: rule.Name, Match: match})
+			return rule.Replacement
+		})
+		applied = append(applied, rule.Replacement)
+	}
+	return content, hits
+}
+
+// DefaultMaskRules returns the built-in rule set, in an order chosen so
+// that more specific patterns (UUID) run before broader ones (HEX) that
+// would otherwise shadow them.
+func DefaultMaskRules() []MaskRule {
+	return []MaskRule{
+		{
+			Name:        "uuid",
+			Pattern:     regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`),
+			Replacement: "<UUID>",
+		},
+		{
+			Name:        "ts",
+			Pattern:     regexp.MustCompile(`\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:?\d{2})?`),
+			Replacement: "<TS>",
+		},
+		{
+			Name: "ipv6",
+			// Covers both fully-written addresses and the "::"
+			// zero-compression form (e.g. "::1", "2001:db8::1"),
+			// which is how most real IPv6 addresses are written.
+			Pattern:     regexp.MustCompile(`\b(?:[0-9a-fA-F]{1,4}:){2,7}[0-9a-fA-F]{1,4}\b|(?:[0-9a-fA-F]{1,4}:){1,7}:(?:[0-9a-fA-F]{1,4}(?::[0-9a-fA-F]{1,4})*\b)?|::(?:[0-9a-fA-F]{1,4}(?::[0-9a-fA-F]{1,4})*\b)?`),
+			Replacement: "<IP>",
+		},
+		{
+			Name:        "ipv4",
+			Pattern:     regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`),
+			Replacement: "<IP>",
+		},
+		{
+			Name:        "duration",
+			Pattern:     regexp.MustCompile(`\b\d+(\.\d+)?(ns|us|µs|ms|s|m|h)\b`),
+			Replacement: "<DURATION>",
+		},
+		{
+			Name:        "hex",
+			Pattern:     regexp.MustCompile(`\b[0-9a-fA-F]{12,}\b`),
+			Replacement: "<HEX>",
+		},
+		{
+			Name:        "path",
+			Pattern:     regexp.MustCompile(`(?:/[\w.-]*\d[\w.-]*){2,}`),
+			Replacement: "<PATH>",
+		},
+		{
+			Name:        "qstr",
+			Pattern:     regexp.MustCompile(`"[^"]*"|'[^']*'`),
+			Replacement: "<QSTR>",
+		},
+	}
+}
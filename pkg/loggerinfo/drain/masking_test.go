@@ -0,0 +1,46 @@
+package drain
+
+import "testing"
+
+func TestMaskerApplyQuotedValuesKeepEarlierMasks(t *testing.T) {
+	m := NewMasker(DefaultMaskRules())
+	got, _ := m.Apply(`time="2024-01-01T00:00:00Z" msg="user 10.0.0.1 connected"`)
+	want := `time="<TS>" msg="user <IP> connected"`
+	if got != want {
+		t.Fatalf("Apply() = %q, want %q", got, want)
+	}
+}
+
+func TestMaskerApplyIPv6Compression(t *testing.T) {
+	m := NewMasker(DefaultMaskRules())
+	for _, line := range []string{"::1", "2001:db8::1", "fe80::1"} {
+		got, hits := m.Apply(line)
+		if got != "<IP>" {
+			t.Errorf("Apply(%q) = %q, want <IP>", line, got)
+		}
+		if len(hits) != 1 || hits[0].Name != "ipv6" {
+			t.Errorf("Apply(%q) hits = %v, want a single ipv6 hit", line, hits)
+		}
+	}
+}
+
+// BenchmarkMaskerApply and BenchmarkDrainTrain let operators compare
+// ns/op to confirm the masking pipeline stays a small fraction of
+// Train's total cost, as intended by DefaultMaskRules.
+func BenchmarkMaskerApply(b *testing.B) {
+	m := NewMasker(DefaultMaskRules())
+	line := `time="2024-01-01T00:00:00Z" level=info msg="user 10.0.0.1 connected" request_id=550e8400-e29b-41d4-a716-446655440000 path=/var/log/app-1/out.log duration=12.5ms`
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Apply(line)
+	}
+}
+
+func BenchmarkDrainTrain(b *testing.B) {
+	line := `time="2024-01-01T00:00:00Z" level=info msg="user 10.0.0.1 connected" request_id=550e8400-e29b-41d4-a716-446655440000 path=/var/log/app-1/out.log duration=12.5ms`
+	d := New(DefaultConfig())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.Train(line, int64(i))
+	}
+}
@@ -0,0 +1,149 @@
+package drain
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// SampleStrategy decides which raw lines a LogCluster retains in
+// Samples, and how that set evolves once the configured cap is reached.
+// Append is called for every line appended to a cluster, including ones
+// that end up discarded. k is the number of lines the cluster has ever
+// seen, tracked independently of len(samples) so strategies like
+// ReservoirN stay unbiased over the cluster's whole lifetime; max is the
+// configured sample cap (Config.MaxSamples).
+type SampleStrategy interface {
+	Append(samples []string, k int, max int, content string) (newSamples []string, newK int)
+}
+
+// FirstN keeps the first max lines seen by a cluster and discards every
+// line after that. This is Drain's original, default behaviour: cheap,
+// but biased toward however a cluster's template looked early in its
+// life.
+type FirstN struct{}
+
+func (FirstN) Append(samples []string, k int, max int, content string) ([]string, int) {
+	if len(samples) < max {
+		samples = append(samples, content)
+	}
+	return samples, k + 1
+}
+
+// RingLastN keeps the max most recently seen lines, overwriting the
+// oldest slot in round-robin order. The retained lines are always the
+// most recent max, though their slice order is not chronological.
+type RingLastN struct{}
+
+func (RingLastN) Append(samples []string, k int, max int, content string) ([]string, int) {
+	if max <= 0 {
+		return samples, k + 1
+	}
+	if len(samples) < max {
+		samples = append(samples, content)
+	} else {
+		samples[k%max] = content
+	}
+	return samples, k + 1
+}
+
+// ReservoirN implements Vitter's Algorithm R: every line a cluster has
+// ever seen has an equal max/k chance of being among the max retained
+// samples, so late-appearing variants are just as likely to surface as
+// lines from early in the cluster's life.
+type ReservoirN struct{}
+
+func (ReservoirN) Append(samples []string, k int, max int, content string) ([]string, int) {
+	if max <= 0 {
+		return samples, k + 1
+	}
+	if len(samples) < max {
+		samples = append(samples, content)
+	} else if i := rand.Intn(k + 1); i < max {
+		samples[i] = content
+	}
+	return samples, k + 1
+}
+
+// sampleStrategyName and sampleStrategyFromName round-trip a
+// SampleStrategy through a snapshot: the built-in strategies are
+// stateless, so a name is all that needs to survive the wire format.
+// Any strategy not in this set (e.g. a caller-supplied one) snapshots as
+// FirstN, matching setDefaults' fallback.
+func sampleStrategyName(s SampleStrategy) string {
+	switch s.(type) {
+	case RingLastN:
+		return "RingLastN"
+	case ReservoirN:
+		return "ReservoirN"
+	default:
+		return "FirstN"
+	}
+}
+
+func sampleStrategyFromName(name string) SampleStrategy {
+	switch name {
+	case "RingLastN":
+		return RingLastN{}
+	case "ReservoirN":
+		return ReservoirN{}
+	default:
+		return FirstN{}
+	}
+}
+
+// mergeSamples combines two already-sampled sets into one of at most max
+// samples, weighting each candidate by how much of its own source's
+// population it stands in for (aK/len(aSamples) or bK/len(bSamples))
+// rather than by how many samples either source happened to retain.
+// Replaying one side's retained samples through SampleStrategy.Append
+// one at a time treats each of them as a single new arrival, which
+// collapses a 1000:1 population difference between two merged clusters
+// down to roughly a 50/50 split in the result; weighting by population
+// instead keeps ReservoirN's uniform-over-population guarantee intact
+// across a merge.
+//
+// This is the Efraimidis-Spirakis weighted reservoir algorithm (A-Res):
+// every candidate gets a key of rand()^(1/weight), and the max
+// candidates with the largest keys survive. It reduces to plain
+// Algorithm R when every candidate carries the same weight. FirstN and
+// RingLastN samples are merged the same way: each side is weighted by
+// its population, but the result keeps whatever bias toward early or
+// recent lines those samples already had, and it is not ordered by
+// arrival.
+func mergeSamples(aSamples []string, aK int, bSamples []string, bK int, max int) ([]string, int) {
+	totalK := aK + bK
+	if max <= 0 {
+		return nil, totalK
+	}
+
+	type candidate struct {
+		sample string
+		key    float64
+	}
+	candidates := make([]candidate, 0, len(aSamples)+len(bSamples))
+	addWeighted := func(samples []string, k int) {
+		if len(samples) == 0 {
+			return
+		}
+		weight := float64(k) / float64(len(samples))
+		if weight <= 0 {
+			weight = 1
+		}
+		for _, s := range samples {
+			candidates = append(candidates, candidate{sample: s, key: math.Pow(rand.Float64(), 1/weight)})
+		}
+	}
+	addWeighted(aSamples, aK)
+	addWeighted(bSamples, bK)
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].key > candidates[j].key })
+	if len(candidates) > max {
+		candidates = candidates[:max]
+	}
+	merged := make([]string, len(candidates))
+	for i, c := range candidates {
+		merged[i] = c.sample
+	}
+	return merged, totalK
+}
@@ -0,0 +1,96 @@
+package drain
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// TestReservoirNUniformInvariant verifies Vitter's Algorithm R's core
+// guarantee: after k items have been offered, every item seen so far has
+// an equal, max/k chance of surviving in the final sample. The
+// package-level RNG ReservoirN draws from is seeded per trial so the
+// check is reproducible, and the inclusion probability of a fixed item
+// is estimated across many independent trials.
+func TestReservoirNUniformInvariant(t *testing.T) {
+	const (
+		k        = 50
+		max      = 5
+		trials   = 20000
+		targetAt = 10 // index of the item whose inclusion rate we track
+	)
+	want := float64(max) / float64(k)
+	target := strconv.Itoa(targetAt)
+
+	var included int
+	for trial := 0; trial < trials; trial++ {
+		rand.Seed(int64(trial))
+
+		var samples []string
+		sampleK := 0
+		var strategy ReservoirN
+		for i := 0; i < k; i++ {
+			samples, sampleK = strategy.Append(samples, sampleK, max, strconv.Itoa(i))
+		}
+
+		for _, s := range samples {
+			if s == target {
+				included++
+				break
+			}
+		}
+	}
+
+	got := float64(included) / float64(trials)
+	if diff := got - want; diff < -0.03 || diff > 0.03 {
+		t.Fatalf("empirical inclusion rate for item %d = %.4f, want ~%.4f (k=%d, max=%d)", targetAt, got, want, k, max)
+	}
+}
+
+// TestMergeSamplesPopulationWeighted checks that merging two ReservoirN
+// samples represents each side in proportion to its true population
+// (aK/bK), not by how many samples each side happened to retain.
+// Replaying a 10,000-line cluster's 10 retained samples into a 10-line
+// cluster's reservoir one at a time, as an earlier version of
+// mergeSamples did, gave the big cluster only a roughly 50/50 share of
+// the merged result instead of the ~99.9% its population warrants.
+func TestMergeSamplesPopulationWeighted(t *testing.T) {
+	const (
+		max      = 10
+		smallPop = 10
+		bigPop   = 10000
+		trials   = 2000
+	)
+	var strategy ReservoirN
+
+	var smallSamples []string
+	smallK := 0
+	for i := 0; i < smallPop; i++ {
+		smallSamples, smallK = strategy.Append(smallSamples, smallK, max, "small-"+strconv.Itoa(i))
+	}
+	var bigSamples []string
+	bigK := 0
+	for i := 0; i < bigPop; i++ {
+		bigSamples, bigK = strategy.Append(bigSamples, bigK, max, "big-"+strconv.Itoa(i))
+	}
+
+	rand.Seed(1)
+	var bigCount int
+	for trial := 0; trial < trials; trial++ {
+		merged, k := mergeSamples(smallSamples, smallK, bigSamples, bigK, max)
+		if k != smallK+bigK {
+			t.Fatalf("merged sampleK = %d, want %d", k, smallK+bigK)
+		}
+		for _, s := range merged {
+			if len(s) >= 3 && s[:3] == "big" {
+				bigCount++
+			}
+		}
+	}
+
+	want := float64(bigK) / float64(smallK+bigK)
+	got := float64(bigCount) / float64(trials*max)
+	if diff := got - want; diff < -0.02 || diff > 0.02 {
+		t.Fatalf("big cluster's share of merged samples = %.4f, want ~%.4f", got, want)
+	}
+}
@@ -0,0 +1,691 @@
+package drain
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Snapshot format: a magic+version header, followed by the effective
+// Config, the cluster counter, the prefix tree (written depth-first:
+// each node's cluster IDs, then its children keyed by token), and
+// finally a cluster table keyed by cluster ID. A CRC32 of everything
+// after the header guards against truncated or corrupted snapshots.
+const (
+	snapshotMagic   = uint32(0x44524e31) // "DRN1"
+	snapshotVersion = uint32(2)
+)
+
+// WriteSnapshot serialises d (its prefix tree, clusters and effective
+// config) to w in a versioned binary format, so that ingesters can
+// restore learned templates across restarts and rolling upgrades via
+// LoadSnapshot. The tree is written depth-first as it is visited, so
+// memory use is proportional to the deepest branch rather than the
+// whole tree.
+func (d *Drain) WriteSnapshot(w io.Writer) error {
+	if err := writeUint32(w, snapshotMagic); err != nil {
+		return err
+	}
+	if err := writeUint32(w, snapshotVersion); err != nil {
+		return err
+	}
+	cw := &crcWriter{w: w, crc: crc32.NewIEEE()}
+	if err := writeConfig(cw, d.config); err != nil {
+		return err
+	}
+	if err := writeInt64(cw, int64(d.clustersCounter)); err != nil {
+		return err
+	}
+	if err := writeNode(cw, d.rootNode); err != nil {
+		return err
+	}
+	if err := writeClusterTable(cw, d.idToCluster); err != nil {
+		return err
+	}
+	return writeUint32(w, cw.crc.Sum32())
+}
+
+// LoadSnapshot reconstructs a *Drain from a snapshot written by
+// WriteSnapshot. cfg governs the returned Drain going forward, so
+// operators may change tunables across a restart; the config embedded
+// in the snapshot is only decoded to advance past it and is not applied.
+// Match results against the restored Drain are identical to those of
+// the Drain that produced the snapshot, provided cfg is unchanged.
+func LoadSnapshot(r io.Reader, cfg *Config) (*Drain, error) {
+	cfg.setDefaults()
+
+	magic, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	if magic != snapshotMagic {
+		return nil, fmt.Errorf("drain: not a drain snapshot (bad magic %#x)", magic)
+	}
+	version, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	if version != snapshotVersion {
+		return nil, fmt.Errorf("drain: unsupported snapshot version %d", version)
+	}
+
+	cr := &crcReader{r: r, crc: crc32.NewIEEE()}
+	if _, err := readConfig(cr); err != nil {
+		return nil, err
+	}
+	counter, err := readInt64(cr)
+	if err != nil {
+		return nil, err
+	}
+	root, err := readNode(cr)
+	if err != nil {
+		return nil, err
+	}
+	clusters, err := readClusterTable(cr)
+	if err != nil {
+		return nil, err
+	}
+
+	wantCRC, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	if gotCRC := cr.crc.Sum32(); gotCRC != wantCRC {
+		return nil, fmt.Errorf("drain: snapshot CRC mismatch: got %#x, want %#x", gotCRC, wantCRC)
+	}
+
+	d := &Drain{
+		config:          cfg,
+		rootNode:        root,
+		idToCluster:     createLogClusterCache(cfg.MaxClusters),
+		clustersCounter: int(counter),
+		masker:          NewMasker(cfg.Maskers),
+	}
+	for id, c := range clusters {
+		d.idToCluster.Set(id, c)
+	}
+	return d, nil
+}
+
+// Merge folds other's learned clusters into d, matching each of other's
+// templates against d's tree the same way Train would and creating a new
+// cluster when none matches closely enough. This is the mechanism for
+// combining per-shard learners into one Drain.
+func (d *Drain) Merge(other *Drain) error {
+	if other == nil {
+		return nil
+	}
+	for _, oc := range other.Clusters() {
+		contentTokens := d.getContentAsTokens(oc.getTemplate())
+		matchCluster := d.treeSearch(d.rootNode, contentTokens, d.config.SimTh, false)
+		if matchCluster == nil {
+			d.clustersCounter++
+			matchCluster = &LogCluster{
+				Tokens: contentTokens,
+				id:     d.clustersCounter,
+				Volume: Volume{emaTau: d.config.EMATimeConstant},
+			}
+			d.idToCluster.Set(matchCluster.id, matchCluster)
+			d.addSeqToPrefixTree(d.rootNode, matchCluster)
+		} else {
+			matchCluster.Tokens = d.createTemplate(contentTokens, matchCluster.Tokens)
+		}
+		matchCluster.Size += oc.Size
+		matchCluster.Samples, matchCluster.sampleK = mergeSamples(
+			matchCluster.Samples, matchCluster.sampleK, oc.Samples, oc.sampleK, d.config.MaxSamples)
+		matchCluster.Volume.Values = mergeVolumeValues(matchCluster.Volume.Values, oc.Volume.Values)
+		mergeVolumeState(&matchCluster.Volume, oc.Volume)
+	}
+	return nil
+}
+
+// mergeVolumeState folds src's EMA/peak/last-sample state into dst, so a
+// cluster touched by Merge keeps working with Volume.IsBurst instead of
+// going cold. The side with the more recent lastSampleNs wins rEMA and
+// rLast, since it reflects the freshest rate estimate; rPeak is always
+// the max of both sides.
+func mergeVolumeState(dst *Volume, src Volume) {
+	if src.lastSampleNs > dst.lastSampleNs {
+		dst.rEMA = src.rEMA
+		dst.rLast = src.rLast
+		dst.lastSampleNs = src.lastSampleNs
+	}
+	if src.rPeak > dst.rPeak {
+		dst.rPeak = src.rPeak
+	}
+	if dst.emaTau <= 0 {
+		dst.emaTau = src.emaTau
+	}
+}
+
+// mergeVolumeValues folds src's bucketed counts into dst, returning a
+// merged slice still sorted by timestamp. Buckets present in both are
+// summed; buckets unique to either side are carried over as-is.
+func mergeVolumeValues(dst, src [][2]int64) [][2]int64 {
+	if len(src) == 0 {
+		return dst
+	}
+	if len(dst) == 0 {
+		out := make([][2]int64, len(src))
+		copy(out, src)
+		return out
+	}
+	out := make([][2]int64, 0, len(dst)+len(src))
+	i, j := 0, 0
+	for i < len(dst) && j < len(src) {
+		switch {
+		case dst[i][0] < src[j][0]:
+			out = append(out, dst[i])
+			i++
+		case dst[i][0] > src[j][0]:
+			out = append(out, src[j])
+			j++
+		default:
+			out = append(out, [2]int64{dst[i][0], dst[i][1] + src[j][1]})
+			i++
+			j++
+		}
+	}
+	out = append(out, dst[i:]...)
+	out = append(out, src[j:]...)
+	return out
+}
+
+func writeNode(w io.Writer, n *Node) error {
+	if err := writeInts(w, n.clusterIDs); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(n.keyToChildNode))
+	for k := range n.keyToChildNode {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if err := writeUint32(w, uint32(len(keys))); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := writeString(w, k); err != nil {
+			return err
+		}
+		if err := writeNode(w, n.keyToChildNode[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readNode(r io.Reader) (*Node, error) {
+	n := createNode()
+	ids, err := readInts(r)
+	if err != nil {
+		return nil, err
+	}
+	n.clusterIDs = ids
+	childCount, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < childCount; i++ {
+		key, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		child, err := readNode(r)
+		if err != nil {
+			return nil, err
+		}
+		n.keyToChildNode[key] = child
+	}
+	return n, nil
+}
+
+func writeClusterTable(w io.Writer, cache *LogClusterCache) error {
+	clusters := cache.Values()
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i].id < clusters[j].id })
+	if err := writeUint32(w, uint32(len(clusters))); err != nil {
+		return err
+	}
+	for _, c := range clusters {
+		if err := writeCluster(w, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readClusterTable(r io.Reader) (map[int]*LogCluster, error) {
+	count, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	clusters := make(map[int]*LogCluster, count)
+	for i := uint32(0); i < count; i++ {
+		c, err := readCluster(r)
+		if err != nil {
+			return nil, err
+		}
+		clusters[c.id] = c
+	}
+	return clusters, nil
+}
+
+func writeCluster(w io.Writer, c *LogCluster) error {
+	if err := writeInt64(w, int64(c.id)); err != nil {
+		return err
+	}
+	if err := writeInt64(w, int64(c.Size)); err != nil {
+		return err
+	}
+	if err := writeStrings(w, c.Tokens); err != nil {
+		return err
+	}
+	if err := writeStrings(w, c.Samples); err != nil {
+		return err
+	}
+	if err := writeInt64(w, int64(c.sampleK)); err != nil {
+		return err
+	}
+	return writeVolume(w, &c.Volume)
+}
+
+func readCluster(r io.Reader) (*LogCluster, error) {
+	id, err := readInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	size, err := readInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := readStrings(r)
+	if err != nil {
+		return nil, err
+	}
+	samples, err := readStrings(r)
+	if err != nil {
+		return nil, err
+	}
+	sampleK, err := readInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	vol, err := readVolume(r)
+	if err != nil {
+		return nil, err
+	}
+	return &LogCluster{
+		id:      int(id),
+		Size:    int(size),
+		Tokens:  tokens,
+		Samples: samples,
+		Volume:  vol,
+		sampleK: int(sampleK),
+	}, nil
+}
+
+func writeVolume(w io.Writer, v *Volume) error {
+	if err := writeUint32(w, uint32(len(v.Values))); err != nil {
+		return err
+	}
+	for _, pair := range v.Values {
+		if err := writeInt64(w, pair[0]); err != nil {
+			return err
+		}
+		if err := writeInt64(w, pair[1]); err != nil {
+			return err
+		}
+	}
+	if err := writeFloat64(w, v.rEMA); err != nil {
+		return err
+	}
+	if err := writeFloat64(w, v.rPeak); err != nil {
+		return err
+	}
+	if err := writeFloat64(w, v.rLast); err != nil {
+		return err
+	}
+	if err := writeInt64(w, v.lastSampleNs); err != nil {
+		return err
+	}
+	return writeInt64(w, int64(v.emaTau))
+}
+
+func readVolume(r io.Reader) (Volume, error) {
+	n, err := readUint32(r)
+	if err != nil {
+		return Volume{}, err
+	}
+	values := make([][2]int64, n)
+	for i := range values {
+		ts, err := readInt64(r)
+		if err != nil {
+			return Volume{}, err
+		}
+		cnt, err := readInt64(r)
+		if err != nil {
+			return Volume{}, err
+		}
+		values[i] = [2]int64{ts, cnt}
+	}
+	rEMA, err := readFloat64(r)
+	if err != nil {
+		return Volume{}, err
+	}
+	rPeak, err := readFloat64(r)
+	if err != nil {
+		return Volume{}, err
+	}
+	rLast, err := readFloat64(r)
+	if err != nil {
+		return Volume{}, err
+	}
+	lastSampleNs, err := readInt64(r)
+	if err != nil {
+		return Volume{}, err
+	}
+	tau, err := readInt64(r)
+	if err != nil {
+		return Volume{}, err
+	}
+	return Volume{
+		Values:       values,
+		rEMA:         rEMA,
+		rPeak:        rPeak,
+		rLast:        rLast,
+		lastSampleNs: lastSampleNs,
+		emaTau:       time.Duration(tau),
+	}, nil
+}
+
+func writeConfig(w io.Writer, c *Config) error {
+	if err := writeInt64(w, int64(c.LogClusterDepth)); err != nil {
+		return err
+	}
+	if err := writeFloat64(w, c.SimTh); err != nil {
+		return err
+	}
+	if err := writeInt64(w, int64(c.MaxChildren)); err != nil {
+		return err
+	}
+	if err := writeStrings(w, c.ExtraDelimiters); err != nil {
+		return err
+	}
+	if err := writeInt64(w, int64(c.MaxClusters)); err != nil {
+		return err
+	}
+	if err := writeString(w, c.ParamString); err != nil {
+		return err
+	}
+	if err := writeFloat64(w, c.BurstThreshold); err != nil {
+		return err
+	}
+	if err := writeInt64(w, int64(c.EMATimeConstant)); err != nil {
+		return err
+	}
+	if err := writeMaskRules(w, c.Maskers); err != nil {
+		return err
+	}
+	if err := writeInt64(w, int64(c.MaxSamples)); err != nil {
+		return err
+	}
+	if err := writeString(w, sampleStrategyName(c.SampleStrategy)); err != nil {
+		return err
+	}
+	if err := writeFloat64(w, c.MergeSimTh); err != nil {
+		return err
+	}
+	return writeInt64(w, int64(c.CompactionInterval))
+}
+
+// readConfig decodes the config section of a snapshot. LoadSnapshot
+// only calls it to advance past that section and always favours the
+// caller's cfg over the decoded one, so a mismatch between the two is
+// never detected or enforced here.
+func readConfig(r io.Reader) (*Config, error) {
+	depth, err := readInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	simTh, err := readFloat64(r)
+	if err != nil {
+		return nil, err
+	}
+	maxChildren, err := readInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	extraDelimiters, err := readStrings(r)
+	if err != nil {
+		return nil, err
+	}
+	maxClusters, err := readInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	paramString, err := readString(r)
+	if err != nil {
+		return nil, err
+	}
+	burstThreshold, err := readFloat64(r)
+	if err != nil {
+		return nil, err
+	}
+	emaTimeConstant, err := readInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	maskers, err := readMaskRules(r)
+	if err != nil {
+		return nil, err
+	}
+	maxSamples, err := readInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	strategyName, err := readString(r)
+	if err != nil {
+		return nil, err
+	}
+	mergeSimTh, err := readFloat64(r)
+	if err != nil {
+		return nil, err
+	}
+	compactionInterval, err := readInt64(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Config{
+		LogClusterDepth:    int(depth),
+		SimTh:              simTh,
+		MaxChildren:        int(maxChildren),
+		ExtraDelimiters:    extraDelimiters,
+		MaxClusters:        int(maxClusters),
+		ParamString:        paramString,
+		BurstThreshold:     burstThreshold,
+		EMATimeConstant:    time.Duration(emaTimeConstant),
+		Maskers:            maskers,
+		MaxSamples:         int(maxSamples),
+		SampleStrategy:     sampleStrategyFromName(strategyName),
+		MergeSimTh:         mergeSimTh,
+		CompactionInterval: time.Duration(compactionInterval),
+	}, nil
+}
+
+// writeMaskRules serialises a mask pipeline by each rule's name, regexp
+// source and replacement; readMaskRules recompiles the pattern on load.
+func writeMaskRules(w io.Writer, rules []MaskRule) error {
+	if err := writeUint32(w, uint32(len(rules))); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if err := writeString(w, rule.Name); err != nil {
+			return err
+		}
+		if err := writeString(w, rule.Pattern.String()); err != nil {
+			return err
+		}
+		if err := writeString(w, rule.Replacement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readMaskRules(r io.Reader) ([]MaskRule, error) {
+	n, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]MaskRule, n)
+	for i := range rules {
+		name, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		pattern, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		replacement, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		rules[i] = MaskRule{Name: name, Pattern: re, Replacement: replacement}
+	}
+	return rules, nil
+}
+
+type crcWriter struct {
+	w   io.Writer
+	crc hash.Hash32
+}
+
+func (c *crcWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if n > 0 {
+		c.crc.Write(p[:n])
+	}
+	return n, err
+}
+
+type crcReader struct {
+	r   io.Reader
+	crc hash.Hash32
+}
+
+func (c *crcReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.crc.Write(p[:n])
+	}
+	return n, err
+}
+
+func writeUint32(w io.Writer, v uint32) error { return binary.Write(w, binary.BigEndian, v) }
+func writeInt64(w io.Writer, v int64) error   { return binary.Write(w, binary.BigEndian, v) }
+func writeFloat64(w io.Writer, v float64) error {
+	return binary.Write(w, binary.BigEndian, v)
+}
+
+func writeString(w io.Writer, s string) error {
+	if err := writeUint32(w, uint32(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+func writeStrings(w io.Writer, ss []string) error {
+	if err := writeUint32(w, uint32(len(ss))); err != nil {
+		return err
+	}
+	for _, s := range ss {
+		if err := writeString(w, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeInts(w io.Writer, ints []int) error {
+	if err := writeUint32(w, uint32(len(ints))); err != nil {
+		return err
+	}
+	for _, v := range ints {
+		if err := writeInt64(w, int64(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readUint32(r io.Reader) (uint32, error) {
+	var v uint32
+	err := binary.Read(r, binary.BigEndian, &v)
+	return v, err
+}
+
+func readInt64(r io.Reader) (int64, error) {
+	var v int64
+	err := binary.Read(r, binary.BigEndian, &v)
+	return v, err
+}
+
+func readFloat64(r io.Reader) (float64, error) {
+	var v float64
+	err := binary.Read(r, binary.BigEndian, &v)
+	return v, err
+}
+
+func readString(r io.Reader) (string, error) {
+	n, err := readUint32(r)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func readStrings(r io.Reader) ([]string, error) {
+	n, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, n)
+	for i := range out {
+		s, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = s
+	}
+	return out, nil
+}
+
+func readInts(r io.Reader) ([]int, error) {
+	n, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]int, n)
+	for i := range out {
+		v, err := readInt64(r)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = int(v)
+	}
+	return out, nil
+}
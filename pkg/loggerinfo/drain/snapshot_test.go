@@ -0,0 +1,71 @@
+package drain
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	d := New(DefaultConfig())
+	lines := []string{
+		"user 1 logged in from 10.0.0.1",
+		"user 2 logged in from 10.0.0.2",
+		"disk usage at 91 percent on node-7",
+	}
+	for i, line := range lines {
+		d.Train(line, int64(i)*timeResolution)
+	}
+
+	var buf bytes.Buffer
+	if err := d.WriteSnapshot(&buf); err != nil {
+		t.Fatalf("WriteSnapshot: %v", err)
+	}
+
+	restored, err := LoadSnapshot(&buf, DefaultConfig())
+	if err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+
+	for _, line := range lines {
+		want := d.Match(line)
+		got := restored.Match(line)
+		if want == nil || got == nil {
+			t.Fatalf("Match(%q): want=%v got=%v", line, want, got)
+		}
+		if want.String() != got.String() {
+			t.Fatalf("Match(%q) template mismatch: want %q, got %q", line, want.String(), got.String())
+		}
+	}
+}
+
+// FuzzSnapshotRoundTrip checks that training a single line, round
+// tripping the Drain through WriteSnapshot/LoadSnapshot, and matching
+// the same line again never flips whether it matches.
+func FuzzSnapshotRoundTrip(f *testing.F) {
+	f.Add("alpha user logged in from 10.0.0.1", int64(1))
+	f.Add("bravo disk usage 42 percent on node-3", int64(2))
+	f.Add("", int64(0))
+
+	f.Fuzz(func(t *testing.T, line string, ts int64) {
+		d := New(DefaultConfig())
+		d.Train(line, ts)
+
+		var buf bytes.Buffer
+		if err := d.WriteSnapshot(&buf); err != nil {
+			t.Fatalf("WriteSnapshot: %v", err)
+		}
+
+		restored, err := LoadSnapshot(&buf, DefaultConfig())
+		if err != nil {
+			t.Fatalf("LoadSnapshot: %v", err)
+		}
+
+		want, got := d.Match(line), restored.Match(line)
+		if (want == nil) != (got == nil) {
+			t.Fatalf("Match(%q) presence mismatch after round trip: want %v, got %v", line, want, got)
+		}
+		if want != nil && want.String() != got.String() {
+			t.Fatalf("Match(%q) template mismatch after round trip: want %q, got %q", line, want.String(), got.String())
+		}
+	})
+}